@@ -4,187 +4,75 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
-	"time"
+
+	"github.com/BurntSushi/rebar/engines/internal/harness"
 )
 
+// config bundles the engine-agnostic harness.Config with the compiled
+// stdlib regexp for this run.
 type config struct {
-	Name            string
-	Model           string
-	Pattern         string
-	Regexp          *regexp.Regexp
-	CaseInsensitive bool
-	Unicode         bool
-	Haystack        []byte
-	MaxIters        int
-	MaxWarmupIters  int
-	MaxTime         time.Duration
-	MaxWarmupTime   time.Duration
+	*harness.Config
+	Flags  harness.Flags
+	Regexp *regexp.Regexp
 }
 
-func parseConfig(rdr io.Reader) (*config, error) {
-	c := &config{}
-	raw, err := io.ReadAll(rdr)
-	if err != nil {
-		return nil, errors.New("failed to read KLV data from reader")
+func newConfig(hc *harness.Config, flags harness.Flags) (*config, error) {
+	c := &config{Config: hc, Flags: flags}
+	if hc.Model == "regex-redux" {
+		return c, nil
 	}
-	patterns := []string{}
-	for len(raw) > 0 {
-		klv, nread, err := parseOneKLV(raw)
-		if err != nil {
-			return nil, err
-		}
-		raw = raw[nread:]
-		switch klv.Key {
-		case "name":
-			c.Name = string(klv.Value)
-		case "model":
-			c.Model = string(klv.Value)
-		case "pattern":
-			patterns = append(patterns, string(klv.Value))
-		case "case-insensitive":
-			c.CaseInsensitive = string(klv.Value) == "true"
-		case "unicode":
-			c.Unicode = string(klv.Value) == "true"
-		case "haystack":
-			c.Haystack = klv.Value
-		case "max-iters":
-			n, err := strconv.Atoi(string(klv.Value))
-			if err != nil {
-				return nil, fmt.Errorf(
-					"failed to parse 'max-iters': %w",
-					err,
-				)
-			}
-			c.MaxIters = n
-		case "max-warmup-iters":
-			n, err := strconv.Atoi(string(klv.Value))
-			if err != nil {
-				return nil, fmt.Errorf(
-					"failed to parse 'max-warmup-iters': %w",
-					err,
-				)
-			}
-			c.MaxWarmupIters = n
-		case "max-time":
-			n, err := strconv.Atoi(string(klv.Value))
-			if err != nil {
-				return nil, fmt.Errorf(
-					"failed to parse 'max-time': %w",
-					err,
-				)
-			}
-			c.MaxTime = time.Duration(int64(n))
-		case "max-warmup-time":
-			n, err := strconv.Atoi(string(klv.Value))
-			if err != nil {
-				return nil, fmt.Errorf(
-					"failed to parse 'max-warmup-time': %w",
-					err,
-				)
-			}
-			c.MaxWarmupTime = time.Duration(int64(n))
-		default:
-			return nil, fmt.Errorf(
-				"unrecognized KLV item key '%s'",
-				klv.Key,
-			)
-		}
-	}
-	if c.Model != "regex-redux" {
-		if len(patterns) != 1 {
-			return nil, errors.New("number of patterns must be 1")
-		}
-		c.Pattern = patterns[0]
-		c.Regexp, err = regexp.Compile(c.pattern())
-		if err != nil {
-			return nil, fmt.Errorf(
-				"failed to compile regexp: %w",
-				err,
-			)
-		}
-	}
-	return c, nil
-}
-
-type oneKLV struct {
-	Key   string
-	Value []byte
-}
-
-func parseOneKLV(raw []byte) (*oneKLV, int, error) {
-	pieces := bytes.SplitN(raw, []byte(":"), 3)
-	if len(pieces) < 3 {
-		return nil, 0, errors.New("invalid KLV item: not enough pieces")
-	}
-	key := string(pieces[0])
-	valueLen, err := strconv.Atoi(string(pieces[1]))
+	pattern, err := hc.Pattern()
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to parse value length: %w", err)
+		return nil, err
 	}
-	rest := pieces[2]
-	if len(rest) < valueLen {
-		return nil, 0, fmt.Errorf(
-			"not enough bytes remaining for length %d for key '%s'",
-			valueLen,
-			key,
-		)
-	}
-	value := rest[:valueLen]
-	rest = rest[valueLen:]
-	if len(rest) == 0 || rest[0] != '\n' {
-		return nil, 0, fmt.Errorf(
-			"did not find \\n after value for key '%s'",
-			key,
-		)
+	re, err := regexp.Compile(c.pattern(pattern))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regexp: %w", err)
 	}
-	nread := len(pieces[0]) + 1 + len(pieces[1]) + 1 + len(value) + 1
-	return &oneKLV{Key: key, Value: value}, nread, nil
+	c.Regexp = re
+	return c, nil
 }
 
-func (c *config) pattern() string {
-	// OK because config parsing fails if number of patterns != 1.
+func (c *config) pattern(pattern string) string {
 	if c.CaseInsensitive {
-		c.Pattern = "(?i:" + c.Pattern + ")"
+		pattern = "(?i:" + pattern + ")"
 	}
 	// Go doesn't have a "Unicode" mode. It is always enabled.
 	// But note that \w, \d and \s are *not* Unicode aware and
 	// there is no way to make them Unicode aware.
-	return c.Pattern
-}
-
-type sample struct {
-	Duration time.Duration
-	Count    int
+	return pattern
 }
 
-func modelCompile(c *config) ([]sample, error) {
+func modelCompile(c *config) ([]harness.Sample, error) {
 	// Config parsing already compiles the pattern
 	// for convenience, but we obviously ignore that
 	// here because we want to measure compilation.
-	p := c.pattern()
+	pattern, err := c.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	p := c.pattern(pattern)
 	bench := func() (*regexp.Regexp, error) {
 		return regexp.Compile(p)
 	}
 	count := func(re *regexp.Regexp) (int, error) {
 		return len(re.FindAllIndex(c.Haystack, -1)), nil
 	}
-	return runAndCount(c, count, bench)
+	return harness.RunAndCount(c.Config, c.Flags, count, bench)
 }
 
-func modelCount(c *config) ([]sample, error) {
-	return run(c, func() (int, error) {
+func modelCount(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
 		return len(c.Regexp.FindAllIndex(c.Haystack, -1)), nil
 	})
 }
 
-func modelCountSpans(c *config) ([]sample, error) {
-	return run(c, func() (int, error) {
+func modelCountSpans(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
 		sum := 0
 		for _, m := range c.Regexp.FindAllIndex(c.Haystack, -1) {
 			sum += m[1] - m[0]
@@ -193,8 +81,8 @@ func modelCountSpans(c *config) ([]sample, error) {
 	})
 }
 
-func modelCountCaptures(c *config) ([]sample, error) {
-	return run(c, func() (int, error) {
+func modelCountCaptures(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
 		count := 0
 		matches := c.Regexp.FindAllSubmatchIndex(c.Haystack, -1)
 		for _, match := range matches {
@@ -208,8 +96,8 @@ func modelCountCaptures(c *config) ([]sample, error) {
 	})
 }
 
-func modelGrep(c *config) ([]sample, error) {
-	return run(c, func() (int, error) {
+func modelGrep(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
 		count := 0
 		lines := bytes.Split(c.Haystack, []byte{'\n'})
 		// Get rid of the empty line when haystack ends with \n.
@@ -228,8 +116,8 @@ func modelGrep(c *config) ([]sample, error) {
 	})
 }
 
-func modelGrepCaptures(c *config) ([]sample, error) {
-	return run(c, func() (int, error) {
+func modelGrepCaptures(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
 		count := 0
 		lines := bytes.Split(c.Haystack, []byte{'\n'})
 		// Get rid of the empty line when haystack ends with \n.
@@ -253,7 +141,57 @@ func modelGrepCaptures(c *config) ([]sample, error) {
 	})
 }
 
-func modelRegexRedux(c *config) ([]sample, error) {
+// modelGrepStream is like modelGrep, but uses harness.ScanLines instead
+// of materializing every line up front with bytes.Split.
+func modelGrepStream(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return harness.ScanLines(c.Haystack, func(line []byte) (bool, error) {
+			return c.Regexp.Match(line), nil
+		})
+	})
+}
+
+// modelReplace substitutes up to c.ReplaceLimit matches (1 by default)
+// with c.Replacement, reporting the number of bytes produced.
+func modelReplace(c *config) ([]harness.Sample, error) {
+	repl := []byte(c.Replacement)
+	limit := c.ReplaceLimit
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return len(replaceLimited(c.Regexp, c.Haystack, repl, limit)), nil
+	})
+}
+
+// modelReplaceAll substitutes every match with c.Replacement, reporting
+// the number of bytes produced. Unlike modelReplace, it ignores
+// c.ReplaceLimit.
+func modelReplaceAll(c *config) ([]harness.Sample, error) {
+	repl := []byte(c.Replacement)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return len(replaceLimited(c.Regexp, c.Haystack, repl, -1)), nil
+	})
+}
+
+// replaceLimited substitutes repl (which may use "$1"-style references,
+// same as regexp.Regexp.ReplaceAll) for the first limit matches of re in
+// src, leaving the rest untouched. A negative limit means "replace
+// everything". It uses FindAllSubmatchIndex's own limit rather than
+// searching for every match and only then truncating, so "replace" with
+// a small limit doesn't do the same amount of scanning work as
+// "replace-all".
+func replaceLimited(re *regexp.Regexp, src, repl []byte, limit int) []byte {
+	matches := re.FindAllSubmatchIndex(src, limit)
+	out := make([]byte, 0, len(src))
+	last := 0
+	for _, m := range matches {
+		out = append(out, src[last:m[0]]...)
+		out = re.Expand(out, repl, src, m)
+		last = m[1]
+	}
+	out = append(out, src[last:]...)
+	return out
+}
+
+func modelRegexRedux(c *config) ([]harness.Sample, error) {
 	verify := func(output string) error {
 		expected := `
 agggtaaa|tttaccct 6
@@ -328,56 +266,7 @@ agggtaa[cgt]|[acg]ttaccct 43
 		fmt.Fprintf(out, "\n%d\n%d\n%d\n", ilen, clen, len(seq))
 		return len(seq), verify(out.String())
 	}
-	return run(c, bench)
-}
-
-func run(c *config, bench func() (int, error)) ([]sample, error) {
-	count := func(n int) (int, error) { return n, nil }
-	return runAndCount(c, count, bench)
-}
-
-func runAndCount[T any](
-	c *config,
-	count func(T) (int, error),
-	bench func() (T, error),
-) ([]sample, error) {
-	warmupStart := time.Now()
-	for i := 0; i < c.MaxWarmupIters; i++ {
-		result, err := bench()
-		if err != nil {
-			return nil, err
-		}
-		_, err = count(result)
-		if err != nil {
-			return nil, err
-		}
-		if time.Since(warmupStart) >= c.MaxWarmupTime {
-			break
-		}
-	}
-
-	results := []sample{}
-	runStart := time.Now()
-	for i := 0; i < c.MaxIters; i++ {
-		benchStart := time.Now()
-		result, err := bench()
-		elapsed := time.Since(benchStart)
-		if err != nil {
-			return nil, err
-		}
-		n, err := count(result)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, sample{
-			Duration: elapsed,
-			Count:    n,
-		})
-		if time.Since(runStart) >= c.MaxTime {
-			break
-		}
-	}
-	return results, nil
+	return harness.Run(c.Config, c.Flags, bench)
 }
 
 func main() {
@@ -388,16 +277,23 @@ func main() {
 }
 
 func tryMain() error {
-	if len(os.Args) == 2 && os.Args[1] == "version" {
+	flags, err := harness.ParseFlags(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if flags.Version {
 		fmt.Println(runtime.Version())
 		return nil
 	}
-	quiet := len(os.Args) == 2 && os.Args[1] == "--quiet"
-	c, err := parseConfig(os.Stdin)
+	hc, err := harness.ParseConfig(os.Stdin)
 	if err != nil {
 		return fmt.Errorf("failed to read stdin: %w", err)
 	}
-	var results []sample
+	c, err := newConfig(hc, flags)
+	if err != nil {
+		return err
+	}
+	var results []harness.Sample
 	switch c.Model {
 	case "compile":
 		results, err = modelCompile(c)
@@ -429,6 +325,21 @@ func tryMain() error {
 		if err != nil {
 			return err
 		}
+	case "grep-stream":
+		results, err = modelGrepStream(c)
+		if err != nil {
+			return err
+		}
+	case "replace":
+		results, err = modelReplace(c)
+		if err != nil {
+			return err
+		}
+	case "replace-all":
+		results, err = modelReplaceAll(c)
+		if err != nil {
+			return err
+		}
 	case "regex-redux":
 		results, err = modelRegexRedux(c)
 		if err != nil {
@@ -437,10 +348,8 @@ func tryMain() error {
 	default:
 		return fmt.Errorf("unrecognized benchmark model '%s'", c.Model)
 	}
-	if !quiet {
-		for _, sample := range results {
-			fmt.Printf("%d,%d\n", int64(sample.Duration), sample.Count)
-		}
+	if !flags.Quiet {
+		harness.PrintSamples(results, flags)
 	}
 	return nil
 }
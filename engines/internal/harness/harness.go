@@ -0,0 +1,382 @@
+// Package harness implements the bits of rebar's KLV protocol and
+// iteration/timing loop that are common to every Go-callable regex engine
+// runner (stdlib regexp, rubex, regexp2, ...). Each runner is responsible
+// for its own pattern compilation (since engines disagree on how flags
+// like "case-insensitive" and "unicode" map to their own options), but
+// everything else -- reading KLV off of stdin, and the warmup/benchmark
+// loop -- stays in lock-step here so the runners can't drift apart.
+package harness
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the fully parsed KLV configuration sent to every runner on
+// stdin. It intentionally does not include a compiled regexp: each runner
+// compiles patterns (and interprets CaseInsensitive/Unicode) using
+// whatever knobs its own engine provides.
+type Config struct {
+	Name            string
+	Model           string
+	Patterns        []string
+	CaseInsensitive bool
+	Unicode         bool
+	Haystack        []byte
+	MaxIters        int
+	MaxWarmupIters  int
+	MaxTime         time.Duration
+	MaxWarmupTime   time.Duration
+	// Replacement is the substitution template for the "replace" and
+	// "replace-all" models.
+	Replacement string
+	// ReplaceLimit caps how many matches the "replace" model will
+	// substitute; it defaults to 1 and is ignored by "replace-all",
+	// which always substitutes every match.
+	ReplaceLimit int
+}
+
+// ParseConfig reads a sequence of KLV items off of rdr and turns them into
+// a Config. It does not interpret or compile any patterns; callers should
+// use Config.Pattern to get at the single pattern when their model
+// requires exactly one.
+func ParseConfig(rdr io.Reader) (*Config, error) {
+	c := &Config{ReplaceLimit: 1}
+	raw, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, errors.New("failed to read KLV data from reader")
+	}
+	for len(raw) > 0 {
+		klv, nread, err := parseOneKLV(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = raw[nread:]
+		switch klv.Key {
+		case "name":
+			c.Name = string(klv.Value)
+		case "model":
+			c.Model = string(klv.Value)
+		case "pattern":
+			c.Patterns = append(c.Patterns, string(klv.Value))
+		case "case-insensitive":
+			c.CaseInsensitive = string(klv.Value) == "true"
+		case "unicode":
+			c.Unicode = string(klv.Value) == "true"
+		case "haystack":
+			c.Haystack = klv.Value
+		case "max-iters":
+			n, err := strconv.Atoi(string(klv.Value))
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to parse 'max-iters': %w",
+					err,
+				)
+			}
+			c.MaxIters = n
+		case "max-warmup-iters":
+			n, err := strconv.Atoi(string(klv.Value))
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to parse 'max-warmup-iters': %w",
+					err,
+				)
+			}
+			c.MaxWarmupIters = n
+		case "max-time":
+			n, err := strconv.Atoi(string(klv.Value))
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to parse 'max-time': %w",
+					err,
+				)
+			}
+			c.MaxTime = time.Duration(int64(n))
+		case "max-warmup-time":
+			n, err := strconv.Atoi(string(klv.Value))
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to parse 'max-warmup-time': %w",
+					err,
+				)
+			}
+			c.MaxWarmupTime = time.Duration(int64(n))
+		case "replacement":
+			c.Replacement = string(klv.Value)
+		case "replace-limit":
+			n, err := strconv.Atoi(string(klv.Value))
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to parse 'replace-limit': %w",
+					err,
+				)
+			}
+			c.ReplaceLimit = n
+		default:
+			return nil, fmt.Errorf(
+				"unrecognized KLV item key '%s'",
+				klv.Key,
+			)
+		}
+	}
+	return c, nil
+}
+
+// Pattern returns the single pattern given in this config, or an error if
+// there wasn't exactly one. Most models require exactly one pattern;
+// models like regex-redux that hard-code their own patterns should just
+// ignore Config.Patterns entirely.
+func (c *Config) Pattern() (string, error) {
+	if len(c.Patterns) != 1 {
+		return "", errors.New("number of patterns must be 1")
+	}
+	return c.Patterns[0], nil
+}
+
+type oneKLV struct {
+	Key   string
+	Value []byte
+}
+
+func parseOneKLV(raw []byte) (*oneKLV, int, error) {
+	pieces := bytes.SplitN(raw, []byte(":"), 3)
+	if len(pieces) < 3 {
+		return nil, 0, errors.New("invalid KLV item: not enough pieces")
+	}
+	key := string(pieces[0])
+	valueLen, err := strconv.Atoi(string(pieces[1]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse value length: %w", err)
+	}
+	rest := pieces[2]
+	if len(rest) < valueLen {
+		return nil, 0, fmt.Errorf(
+			"not enough bytes remaining for length %d for key '%s'",
+			valueLen,
+			key,
+		)
+	}
+	value := rest[:valueLen]
+	rest = rest[valueLen:]
+	if len(rest) == 0 || rest[0] != '\n' {
+		return nil, 0, fmt.Errorf(
+			"did not find \\n after value for key '%s'",
+			key,
+		)
+	}
+	nread := len(pieces[0]) + 1 + len(pieces[1]) + 1 + len(value) + 1
+	return &oneKLV{Key: key, Value: value}, nread, nil
+}
+
+// Sample is one measurement of a single benchmark iteration.
+type Sample struct {
+	Duration time.Duration
+	Count    int
+	// HeapBytes is the number of bytes allocated on the Go heap during
+	// this iteration (a delta of runtime.MemStats.TotalAlloc).
+	HeapBytes uint64
+	// RSSBytes is the change in the process' resident set size over
+	// this iteration, as sampled by currentRSSBytes. It's usually zero,
+	// since what gets sampled is the peak RSS (a high-water mark) and
+	// most iterations don't grow it, but a nonzero value
+	// flags an iteration that pushed the process to allocate more
+	// memory from the OS (e.g. a DFA blowing up its state cache).
+	RSSBytes uint64
+}
+
+// Run is like RunAndCount, but for the common case where bench itself
+// produces the count to report (so there's nothing to translate from the
+// benchmarked result to a count).
+func Run(c *Config, flags Flags, bench func() (int, error)) ([]Sample, error) {
+	count := func(n int) (int, error) { return n, nil }
+	return RunAndCount(c, flags, count, bench)
+}
+
+// RunAndCount runs the warmup and measurement loops described by c. bench
+// is the thing actually being measured, and count turns its result into
+// the integer reported in each Sample (e.g. a match count). Keeping count
+// outside of the timed section lets callers, e.g., measure compilation
+// time without the cost of then using the compiled regexp folded in.
+//
+// flags.WantMemory controls whether each iteration also snapshots heap
+// and RSS usage: runtime.ReadMemStats stops the world, so it's only
+// worth paying for when the caller actually asked for memory numbers.
+func RunAndCount[T any](
+	c *Config,
+	flags Flags,
+	count func(T) (int, error),
+	bench func() (T, error),
+) ([]Sample, error) {
+	measureMemory := flags.WantMemory()
+	warmupStart := time.Now()
+	for i := 0; i < c.MaxWarmupIters; i++ {
+		result, err := bench()
+		if err != nil {
+			return nil, err
+		}
+		_, err = count(result)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(warmupStart) >= c.MaxWarmupTime {
+			break
+		}
+	}
+
+	results := []Sample{}
+	runStart := time.Now()
+	for i := 0; i < c.MaxIters; i++ {
+		var heapBefore, rssBefore uint64
+		if measureMemory {
+			heapBefore, rssBefore = heapAllocBytes(), currentRSSBytes()
+		}
+		benchStart := time.Now()
+		result, err := bench()
+		elapsed := time.Since(benchStart)
+		var heapAfter, rssAfter uint64
+		if measureMemory {
+			heapAfter, rssAfter = heapAllocBytes(), currentRSSBytes()
+		}
+		if err != nil {
+			return nil, err
+		}
+		n, err := count(result)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, Sample{
+			Duration:  elapsed,
+			Count:     n,
+			HeapBytes: saturatingSub(heapAfter, heapBefore),
+			RSSBytes:  saturatingSub(rssAfter, rssBefore),
+		})
+		if time.Since(runStart) >= c.MaxTime {
+			break
+		}
+	}
+	return results, nil
+}
+
+// heapAllocBytes returns the cumulative number of bytes allocated on the
+// Go heap over the life of the process, per runtime.MemStats.TotalAlloc.
+func heapAllocBytes() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.TotalAlloc
+}
+
+// currentRSSBytes returns the process' peak resident set size so far, as
+// reported by rssBytes, or 0 if it couldn't be determined on this
+// platform.
+func currentRSSBytes() uint64 {
+	n, err := rssBytes()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// saturatingSub returns a-b, or 0 if that would be negative. Heap and RSS
+// usage aren't strictly monotonic moment-to-moment (a GC can run between
+// the before/after snapshots), so a naive subtraction can underflow.
+func saturatingSub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+// GrepStreamBufSize bounds how big a single line can be in ScanLines
+// before bufio.Scanner gives up. rebar's haystacks can have long lines,
+// so this needs to be bigger than bufio's default of 64KiB.
+const GrepStreamBufSize = 1 << 20
+
+// ScanLines is the "grep-stream" model shared by every runner: it scans
+// haystack a line at a time with a bufio.Scanner instead of
+// materializing every line up front (e.g. with bytes.Split), and counts
+// how many lines match reports true for. For the large haystacks rebar
+// ships, bytes.Split's per-iteration slice-of-slices allocation
+// dominates the measurement; this is closer to how a tool like ripgrep
+// actually iterates lines.
+func ScanLines(haystack []byte, match func([]byte) (bool, error)) (int, error) {
+	count := 0
+	sc := bufio.NewScanner(bytes.NewReader(haystack))
+	sc.Buffer(make([]byte, 0, GrepStreamBufSize), GrepStreamBufSize)
+	for sc.Scan() {
+		// bufio.ScanLines already strips a trailing \r and never
+		// yields the empty line that follows a final \n, matching
+		// bytes.Split's semantics.
+		ok, err := match(sc.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			count += 1
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Flags holds the command-line flags common to every runner. Unlike
+// Config, these come from argv rather than the KLV protocol on stdin.
+type Flags struct {
+	// Version, when set, means the runner should print its engine
+	// version and exit without reading a Config at all.
+	Version bool
+	// Quiet, when set, means the runner shouldn't print any samples.
+	Quiet bool
+	// Measure is the comma-separated list of things to measure, e.g.
+	// "time" (the default) or "time,memory".
+	Measure string
+}
+
+// ParseFlags parses the runner's command-line arguments (i.e. os.Args[1:]).
+func ParseFlags(args []string) (Flags, error) {
+	f := Flags{Measure: "time"}
+	for _, arg := range args {
+		switch {
+		case arg == "version":
+			f.Version = true
+		case arg == "--quiet":
+			f.Quiet = true
+		case strings.HasPrefix(arg, "--measure="):
+			f.Measure = strings.TrimPrefix(arg, "--measure=")
+		default:
+			return Flags{}, fmt.Errorf("unrecognized argument '%s'", arg)
+		}
+	}
+	return f, nil
+}
+
+// WantMemory reports whether Measure asked for memory stats alongside
+// time.
+func (f Flags) WantMemory() bool {
+	return strings.Contains(f.Measure, "memory")
+}
+
+// PrintSamples writes one CSV line per sample to stdout: duration and
+// count, plus heap/RSS byte deltas when flags asked for memory
+// measurements. The extra columns are opt-in so existing rebar consumers
+// that only expect "duration,count" keep working.
+func PrintSamples(samples []Sample, flags Flags) {
+	for _, s := range samples {
+		if flags.WantMemory() {
+			fmt.Printf(
+				"%d,%d,%d,%d\n",
+				int64(s.Duration), s.Count, s.HeapBytes, s.RSSBytes,
+			)
+		} else {
+			fmt.Printf("%d,%d\n", int64(s.Duration), s.Count)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package harness
+
+import "syscall"
+
+// rssBytes returns the process' current resident set size using
+// getrusage(2)'s ru_maxrss, which on Darwin is already reported in bytes
+// (unlike Linux, where it's kilobytes).
+//
+// Note this is actually a high-water mark, not the "current" RSS, but
+// since we only ever look at the delta between two snapshots that's
+// exactly what we want: it's 0 unless an iteration pushed the process to
+// a new peak.
+func rssBytes() (uint64, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return uint64(ru.Maxrss), nil
+}
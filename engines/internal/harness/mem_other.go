@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !windows
+
+package harness
+
+import "errors"
+
+// rssBytes is unimplemented on this platform. RSS sampling just
+// degrades to always reporting a zero delta; heap sampling is unaffected.
+func rssBytes() (uint64, error) {
+	return 0, errors.New("RSS sampling is not supported on this platform")
+}
@@ -0,0 +1,472 @@
+// Command regexp2 is a rebar runner that benchmarks
+// github.com/dlclark/regexp2, a backtracking engine supporting features
+// Go's stdlib regexp lacks (backreferences, look-around, .NET-style named
+// captures). It shares its KLV parsing and benchmark loop with engines/go
+// and engines/rubex via the harness package.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+
+	"github.com/BurntSushi/rebar/engines/internal/harness"
+)
+
+// config bundles the engine-agnostic harness.Config with the compiled
+// regexp2 regexp for this run.
+type config struct {
+	*harness.Config
+	Flags  harness.Flags
+	Regexp *regexp2.Regexp
+}
+
+func newConfig(hc *harness.Config, flags harness.Flags) (*config, error) {
+	c := &config{Config: hc, Flags: flags}
+	if hc.Model == "regex-redux" {
+		return c, nil
+	}
+	pattern, err := hc.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp2.Compile(pattern, c.options())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regexp: %w", err)
+	}
+	c.Regexp = re
+	return c, nil
+}
+
+// options translates the KLV "case-insensitive" and "unicode" flags into
+// regexp2.RegexOptions, rather than ignoring "unicode" the way the
+// original single-engine runner did.
+func (c *config) options() regexp2.RegexOptions {
+	opts := regexp2.None
+	if c.CaseInsensitive {
+		opts |= regexp2.IgnoreCase
+	}
+	if !c.Unicode {
+		// regexp2's \w, \d and \s are Unicode-aware by default.
+		// ECMAScript mode restricts them to ASCII semantics, which
+		// is the closest match to "unicode: false".
+		opts |= regexp2.ECMAScript
+	}
+	return opts
+}
+
+// allMatches collects every non-overlapping match in s, since regexp2
+// only exposes matches one at a time via FindNextMatch.
+func allMatches(re *regexp2.Regexp, s string) ([]*regexp2.Match, error) {
+	matches := []*regexp2.Match{}
+	m, err := re.FindStringMatch(s)
+	if err != nil {
+		return nil, err
+	}
+	for m != nil {
+		matches = append(matches, m)
+		m, err = re.FindNextMatch(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+func modelCompile(c *config) ([]harness.Sample, error) {
+	// Config parsing already compiles the pattern
+	// for convenience, but we obviously ignore that
+	// here because we want to measure compilation.
+	pattern, err := c.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	opts := c.options()
+	bench := func() (*regexp2.Regexp, error) {
+		return regexp2.Compile(pattern, opts)
+	}
+	count := func(re *regexp2.Regexp) (int, error) {
+		matches, err := allMatches(re, string(c.Haystack))
+		if err != nil {
+			return 0, err
+		}
+		return len(matches), nil
+	}
+	return harness.RunAndCount(c.Config, c.Flags, count, bench)
+}
+
+func modelCount(c *config) ([]harness.Sample, error) {
+	haystack := string(c.Haystack)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		matches, err := allMatches(c.Regexp, haystack)
+		if err != nil {
+			return 0, err
+		}
+		return len(matches), nil
+	})
+}
+
+func modelCountSpans(c *config) ([]harness.Sample, error) {
+	haystack := string(c.Haystack)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		matches, err := allMatches(c.Regexp, haystack)
+		if err != nil {
+			return 0, err
+		}
+		sum := 0
+		for _, m := range matches {
+			// m.Length counts runes, not bytes (that's how
+			// regexp2.Capture.Length is documented), but
+			// engines/go and engines/rubex's count-spans sum
+			// byte spans from FindAllIndex. Use len(m.String())
+			// instead, since Go's len() on a string is always a
+			// byte count, to keep the unit comparable across
+			// engines.
+			sum += len(m.String())
+		}
+		return sum, nil
+	})
+}
+
+func modelCountCaptures(c *config) ([]harness.Sample, error) {
+	haystack := string(c.Haystack)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		matches, err := allMatches(c.Regexp, haystack)
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, m := range matches {
+			for _, g := range m.Groups() {
+				if len(g.Captures) > 0 {
+					count += 1
+				}
+			}
+		}
+		return count, nil
+	})
+}
+
+// modelCountNamedCaptures is like modelCountCaptures, but only considers
+// groups given an explicit name in the pattern (e.g. `(?P<year>\d{4})`),
+// counting one per match for each named group that captured something.
+func modelCountNamedCaptures(c *config) ([]harness.Sample, error) {
+	haystack := string(c.Haystack)
+	names := namedGroups(c.Regexp.GetGroupNames())
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		matches, err := allMatches(c.Regexp, haystack)
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, m := range matches {
+			for _, name := range names {
+				g := m.GroupByName(name)
+				if g != nil && len(g.Captures) > 0 {
+					count += 1
+				}
+			}
+		}
+		return count, nil
+	})
+}
+
+// namedGroups filters out the implicit numbered group names that
+// GetGroupNames always includes alongside any names given in the pattern.
+func namedGroups(all []string) []string {
+	named := []string{}
+	for _, name := range all {
+		if _, err := strconv.Atoi(name); err != nil {
+			named = append(named, name)
+		}
+	}
+	return named
+}
+
+func modelGrep(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		count := 0
+		lines := bytes.Split(c.Haystack, []byte{'\n'})
+		// Get rid of the empty line when haystack ends with \n.
+		if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+		for _, line := range lines {
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			m, err := c.Regexp.FindStringMatch(string(line))
+			if err != nil {
+				return 0, err
+			}
+			if m != nil {
+				count += 1
+			}
+		}
+		return count, nil
+	})
+}
+
+func modelGrepCaptures(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		count := 0
+		lines := bytes.Split(c.Haystack, []byte{'\n'})
+		// Get rid of the empty line when haystack ends with \n.
+		if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+		for _, line := range lines {
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			matches, err := allMatches(c.Regexp, string(line))
+			if err != nil {
+				return 0, err
+			}
+			for _, m := range matches {
+				for _, g := range m.Groups() {
+					if len(g.Captures) > 0 {
+						count += 1
+					}
+				}
+			}
+		}
+		return count, nil
+	})
+}
+
+// modelGrepStream is like modelGrep, but uses harness.ScanLines instead
+// of materializing every line up front with bytes.Split.
+func modelGrepStream(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return harness.ScanLines(c.Haystack, func(line []byte) (bool, error) {
+			m, err := c.Regexp.FindStringMatch(string(line))
+			if err != nil {
+				return false, err
+			}
+			return m != nil, nil
+		})
+	})
+}
+
+// modelReplace substitutes up to c.ReplaceLimit matches (1 by default)
+// with c.Replacement, reporting the number of bytes produced. Unlike
+// engines/go and engines/rubex, regexp2's Replace takes a match count
+// directly, so there's no need to hand-roll the limiting.
+func modelReplace(c *config) ([]harness.Sample, error) {
+	haystack := string(c.Haystack)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		out, err := c.Regexp.Replace(haystack, c.Replacement, -1, c.ReplaceLimit)
+		if err != nil {
+			return 0, err
+		}
+		return len(out), nil
+	})
+}
+
+// modelReplaceAll substitutes every match with c.Replacement, reporting
+// the number of bytes produced. Unlike modelReplace, it ignores
+// c.ReplaceLimit.
+func modelReplaceAll(c *config) ([]harness.Sample, error) {
+	haystack := string(c.Haystack)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		out, err := c.Regexp.Replace(haystack, c.Replacement, -1, -1)
+		if err != nil {
+			return 0, err
+		}
+		return len(out), nil
+	})
+}
+
+func modelRegexRedux(c *config) ([]harness.Sample, error) {
+	verify := func(output string) error {
+		expected := `
+agggtaaa|tttaccct 6
+[cgt]gggtaaa|tttaccc[acg] 26
+a[act]ggtaaa|tttacc[agt]t 86
+ag[act]gtaaa|tttac[agt]ct 58
+agg[act]taaa|ttta[agt]cct 113
+aggg[acg]aaa|ttt[cgt]ccct 31
+agggt[cgt]aa|tt[acg]accct 31
+agggta[cgt]a|t[acg]taccct 32
+agggtaa[cgt]|[acg]ttaccct 43
+
+1016745
+1000000
+547899
+`[1:]
+		if expected != output {
+			return errors.New(
+				"output did not match what was expected",
+			)
+		}
+		return nil
+	}
+	compile := func(pattern string) *regexp2.Regexp {
+		// This is okay, because all regexes in this
+		// benchmark model are known statically and
+		// we know they are valid.
+		re, err := regexp2.Compile(pattern, c.options())
+		if err != nil {
+			panic(err)
+		}
+		return re
+	}
+	replaceAll := func(re *regexp2.Regexp, input, repl string) string {
+		out, err := re.Replace(input, repl, -1, -1)
+		if err != nil {
+			panic(err)
+		}
+		return out
+	}
+	bench := func() (int, error) {
+		out := new(strings.Builder)
+		seq := string(c.Haystack)
+		ilen := len(seq)
+		seq = replaceAll(compile(`>[^\n]*\n|\n`), seq, "")
+		clen := len(seq)
+
+		variants := []string{
+			`agggtaaa|tttaccct`,
+			`[cgt]gggtaaa|tttaccc[acg]`,
+			`a[act]ggtaaa|tttacc[agt]t`,
+			`ag[act]gtaaa|tttac[agt]ct`,
+			`agg[act]taaa|ttta[agt]cct`,
+			`aggg[acg]aaa|ttt[cgt]ccct`,
+			`agggt[cgt]aa|tt[acg]accct`,
+			`agggta[cgt]a|t[acg]taccct`,
+			`agggtaa[cgt]|[acg]ttaccct`,
+		}
+		for _, variant := range variants {
+			re := compile(variant)
+			matches, err := allMatches(re, seq)
+			if err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(out, "%s %d\n", variant, len(matches))
+		}
+
+		type subst struct {
+			re   *regexp2.Regexp
+			repl string
+		}
+		substs := []subst{
+			subst{compile(`tHa[Nt]`), "<4>"},
+			subst{compile(`aND|caN|Ha[DS]|WaS`), "<3>"},
+			subst{compile(`a[NSt]|BY`), "<2>"},
+			subst{compile(`<[^>]*>`), "|"},
+			subst{compile(`\|[^|][^|]*\|`), "-"},
+		}
+		for _, s := range substs {
+			seq = replaceAll(s.re, seq, s.repl)
+		}
+
+		fmt.Fprintf(out, "\n%d\n%d\n%d\n", ilen, clen, len(seq))
+		return len(seq), verify(out.String())
+	}
+	return harness.Run(c.Config, c.Flags, bench)
+}
+
+func main() {
+	if err := tryMain(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func tryMain() error {
+	flags, err := harness.ParseFlags(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if flags.Version {
+		version := "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, dep := range info.Deps {
+				if dep.Path == "github.com/dlclark/regexp2" {
+					version = dep.Version
+				}
+			}
+		}
+		fmt.Println(version)
+		return nil
+	}
+	hc, err := harness.ParseConfig(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	c, err := newConfig(hc, flags)
+	if err != nil {
+		return err
+	}
+	var results []harness.Sample
+	switch c.Model {
+	case "compile":
+		results, err = modelCompile(c)
+		if err != nil {
+			return err
+		}
+	case "count":
+		results, err = modelCount(c)
+		if err != nil {
+			return err
+		}
+	case "count-spans":
+		results, err = modelCountSpans(c)
+		if err != nil {
+			return err
+		}
+	case "count-captures":
+		results, err = modelCountCaptures(c)
+		if err != nil {
+			return err
+		}
+	case "count-named-captures":
+		results, err = modelCountNamedCaptures(c)
+		if err != nil {
+			return err
+		}
+	case "grep":
+		results, err = modelGrep(c)
+		if err != nil {
+			return err
+		}
+	case "grep-captures":
+		results, err = modelGrepCaptures(c)
+		if err != nil {
+			return err
+		}
+	case "grep-stream":
+		results, err = modelGrepStream(c)
+		if err != nil {
+			return err
+		}
+	case "replace":
+		results, err = modelReplace(c)
+		if err != nil {
+			return err
+		}
+	case "replace-all":
+		results, err = modelReplaceAll(c)
+		if err != nil {
+			return err
+		}
+	case "regex-redux":
+		results, err = modelRegexRedux(c)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unrecognized benchmark model '%s'", c.Model)
+	}
+	if !flags.Quiet {
+		harness.PrintSamples(results, flags)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+// Command rubex is a rebar runner that benchmarks
+// github.com/moovweb/rubex, a cgo binding to Oniguruma. It shares its KLV
+// parsing and benchmark loop with engines/go via the harness package, but
+// compiles patterns itself since Oniguruma's "case insensitive" and
+// "unicode" knobs are options passed to the compiler rather than inline
+// flags in the pattern.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/moovweb/rubex"
+
+	"github.com/BurntSushi/rebar/engines/internal/harness"
+)
+
+// config bundles the engine-agnostic harness.Config with the compiled
+// Oniguruma regexp for this run.
+type config struct {
+	*harness.Config
+	Flags  harness.Flags
+	Regexp *rubex.Regexp
+}
+
+func newConfig(hc *harness.Config, flags harness.Flags) (*config, error) {
+	c := &config{Config: hc, Flags: flags}
+	if hc.Model == "regex-redux" {
+		return c, nil
+	}
+	pattern, err := hc.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	re, err := c.compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regexp: %w", err)
+	}
+	c.Regexp = re
+	return c, nil
+}
+
+// compile translates the KLV "case-insensitive" and "unicode" flags into
+// Oniguruma options, rather than wrapping the pattern in something like
+// Go's "(?i:...)".
+func (c *config) compile(pattern string) (*rubex.Regexp, error) {
+	options := rubex.ONIG_OPTION_CAPTURE_GROUP
+	if c.CaseInsensitive {
+		options |= rubex.ONIG_OPTION_IGNORECASE
+	}
+	// Unlike regexp2, this binding doesn't expose an option to toggle
+	// \w/\d/\s between ASCII and Unicode semantics, so c.Unicode has
+	// nothing to translate to here. (Oniguruma itself supports this
+	// via ONIG_OPTION_ASCII_RANGE, but that option was only added well
+	// after this binding's cgo layer was written, so it isn't wired up
+	// in github.com/moovweb/rubex.)
+	return rubex.NewRegexp(pattern, options)
+}
+
+func modelCompile(c *config) ([]harness.Sample, error) {
+	// Config parsing already compiles the pattern
+	// for convenience, but we obviously ignore that
+	// here because we want to measure compilation.
+	pattern, err := c.Pattern()
+	if err != nil {
+		return nil, err
+	}
+	bench := func() (*rubex.Regexp, error) {
+		return c.compile(pattern)
+	}
+	count := func(re *rubex.Regexp) (int, error) {
+		return len(re.FindAllIndex(c.Haystack, -1)), nil
+	}
+	return harness.RunAndCount(c.Config, c.Flags, count, bench)
+}
+
+func modelCount(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return len(c.Regexp.FindAllIndex(c.Haystack, -1)), nil
+	})
+}
+
+func modelCountSpans(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		sum := 0
+		for _, m := range c.Regexp.FindAllIndex(c.Haystack, -1) {
+			sum += m[1] - m[0]
+		}
+		return sum, nil
+	})
+}
+
+func modelCountCaptures(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		count := 0
+		matches := c.Regexp.FindAllSubmatchIndex(c.Haystack, -1)
+		for _, match := range matches {
+			for i := 0; i < len(match); i += 2 {
+				if match[i] > -1 {
+					count += 1
+				}
+			}
+		}
+		return count, nil
+	})
+}
+
+func modelGrep(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		count := 0
+		lines := bytes.Split(c.Haystack, []byte{'\n'})
+		// Get rid of the empty line when haystack ends with \n.
+		if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+		for _, line := range lines {
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			if c.Regexp.Match(line) {
+				count += 1
+			}
+		}
+		return count, nil
+	})
+}
+
+func modelGrepCaptures(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		count := 0
+		lines := bytes.Split(c.Haystack, []byte{'\n'})
+		// Get rid of the empty line when haystack ends with \n.
+		if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+		for _, line := range lines {
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			matches := c.Regexp.FindAllSubmatchIndex(line, -1)
+			for _, match := range matches {
+				for i := 0; i < len(match); i += 2 {
+					if match[i] > -1 {
+						count += 1
+					}
+				}
+			}
+		}
+		return count, nil
+	})
+}
+
+// modelGrepStream is like modelGrep, but uses harness.ScanLines instead
+// of materializing every line up front with bytes.Split.
+func modelGrepStream(c *config) ([]harness.Sample, error) {
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return harness.ScanLines(c.Haystack, func(line []byte) (bool, error) {
+			return c.Regexp.Match(line), nil
+		})
+	})
+}
+
+// modelReplace substitutes up to c.ReplaceLimit matches (1 by default)
+// with c.Replacement, reporting the number of bytes produced.
+func modelReplace(c *config) ([]harness.Sample, error) {
+	repl := []byte(c.Replacement)
+	limit := c.ReplaceLimit
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return len(replaceLimited(c.Regexp, c.Haystack, repl, limit)), nil
+	})
+}
+
+// modelReplaceAll substitutes every match with c.Replacement, reporting
+// the number of bytes produced. Unlike modelReplace, it ignores
+// c.ReplaceLimit.
+func modelReplaceAll(c *config) ([]harness.Sample, error) {
+	repl := []byte(c.Replacement)
+	return harness.Run(c.Config, c.Flags, func() (int, error) {
+		return len(replaceLimited(c.Regexp, c.Haystack, repl, -1)), nil
+	})
+}
+
+// replaceLimited substitutes repl literally (no "$1"-style back-reference
+// expansion, unlike engines/go) for the first limit matches of re in src,
+// leaving the rest untouched. A negative limit means "replace
+// everything". It uses FindAllIndex's own limit rather than searching
+// for every match and only then truncating, so "replace" with a small
+// limit doesn't do the same amount of scanning work as "replace-all".
+func replaceLimited(re *rubex.Regexp, src, repl []byte, limit int) []byte {
+	matches := re.FindAllIndex(src, limit)
+	out := make([]byte, 0, len(src))
+	last := 0
+	for _, m := range matches {
+		out = append(out, src[last:m[0]]...)
+		out = append(out, repl...)
+		last = m[1]
+	}
+	out = append(out, src[last:]...)
+	return out
+}
+
+func modelRegexRedux(c *config) ([]harness.Sample, error) {
+	verify := func(output string) error {
+		expected := `
+agggtaaa|tttaccct 6
+[cgt]gggtaaa|tttaccc[acg] 26
+a[act]ggtaaa|tttacc[agt]t 86
+ag[act]gtaaa|tttac[agt]ct 58
+agg[act]taaa|ttta[agt]cct 113
+aggg[acg]aaa|ttt[cgt]ccct 31
+agggt[cgt]aa|tt[acg]accct 31
+agggta[cgt]a|t[acg]taccct 32
+agggtaa[cgt]|[acg]ttaccct 43
+
+1016745
+1000000
+547899
+`[1:]
+		if expected != output {
+			return errors.New(
+				"output did not match what was expected",
+			)
+		}
+		return nil
+	}
+	compile := func(pattern string) *rubex.Regexp {
+		// This is okay, because all regexes in this
+		// benchmark model are known statically and
+		// we know they are valid.
+		re, err := c.compile(pattern)
+		if err != nil {
+			panic(err)
+		}
+		return re
+	}
+	bench := func() (int, error) {
+		out := new(strings.Builder)
+		seq := string(c.Haystack)
+		ilen := len(seq)
+		seq = compile(`>[^\n]*\n|\n`).ReplaceAllString(seq, "")
+		clen := len(seq)
+
+		variants := []string{
+			`agggtaaa|tttaccct`,
+			`[cgt]gggtaaa|tttaccc[acg]`,
+			`a[act]ggtaaa|tttacc[agt]t`,
+			`ag[act]gtaaa|tttac[agt]ct`,
+			`agg[act]taaa|ttta[agt]cct`,
+			`aggg[acg]aaa|ttt[cgt]ccct`,
+			`agggt[cgt]aa|tt[acg]accct`,
+			`agggta[cgt]a|t[acg]taccct`,
+			`agggtaa[cgt]|[acg]ttaccct`,
+		}
+		for _, variant := range variants {
+			re := compile(variant)
+			count := len(re.FindAllStringIndex(seq, -1))
+			fmt.Fprintf(out, "%s %d\n", variant, count)
+		}
+
+		type subst struct {
+			re   *rubex.Regexp
+			repl string
+		}
+		substs := []subst{
+			subst{compile(`tHa[Nt]`), "<4>"},
+			subst{compile(`aND|caN|Ha[DS]|WaS`), "<3>"},
+			subst{compile(`a[NSt]|BY`), "<2>"},
+			subst{compile(`<[^>]*>`), "|"},
+			subst{compile(`\|[^|][^|]*\|`), "-"},
+		}
+		for _, s := range substs {
+			seq = s.re.ReplaceAllString(seq, s.repl)
+		}
+
+		fmt.Fprintf(out, "\n%d\n%d\n%d\n", ilen, clen, len(seq))
+		return len(seq), verify(out.String())
+	}
+	return harness.Run(c.Config, c.Flags, bench)
+}
+
+func main() {
+	if err := tryMain(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func tryMain() error {
+	flags, err := harness.ParseFlags(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if flags.Version {
+		version := "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, dep := range info.Deps {
+				if dep.Path == "github.com/moovweb/rubex" {
+					version = dep.Version
+				}
+			}
+		}
+		fmt.Println(version)
+		return nil
+	}
+	hc, err := harness.ParseConfig(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+	c, err := newConfig(hc, flags)
+	if err != nil {
+		return err
+	}
+	var results []harness.Sample
+	switch c.Model {
+	case "compile":
+		results, err = modelCompile(c)
+		if err != nil {
+			return err
+		}
+	case "count":
+		results, err = modelCount(c)
+		if err != nil {
+			return err
+		}
+	case "count-spans":
+		results, err = modelCountSpans(c)
+		if err != nil {
+			return err
+		}
+	case "count-captures":
+		results, err = modelCountCaptures(c)
+		if err != nil {
+			return err
+		}
+	case "grep":
+		results, err = modelGrep(c)
+		if err != nil {
+			return err
+		}
+	case "grep-captures":
+		results, err = modelGrepCaptures(c)
+		if err != nil {
+			return err
+		}
+	case "grep-stream":
+		results, err = modelGrepStream(c)
+		if err != nil {
+			return err
+		}
+	case "replace":
+		results, err = modelReplace(c)
+		if err != nil {
+			return err
+		}
+	case "replace-all":
+		results, err = modelReplaceAll(c)
+		if err != nil {
+			return err
+		}
+	case "regex-redux":
+		results, err = modelRegexRedux(c)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unrecognized benchmark model '%s'", c.Model)
+	}
+	if !flags.Quiet {
+		harness.PrintSamples(results, flags)
+	}
+	return nil
+}